@@ -2,14 +2,17 @@ package couchbase
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/database/helper/connutil"
 	"github.com/mitchellh/mapstructure"
-	"github.com/pkg/errors"
-	"gopkg.in/couchbase/gocb.v1"
-	"sync"
-	"time"
 )
 
 // couchbaseConnectionProducer implements ConnectionProducer
@@ -19,12 +22,18 @@ type couchbaseConnectionProducer struct {
 	Password         string `json:"password" structs:"password" mapstructure:"password"`
 	Bucket           string `json:"bucket" structs:"bucket" mapstructure:"bucket"`
 
+	TLSCA          string `json:"tls_ca" structs:"tls_ca" mapstructure:"tls_ca"`
+	TLSCertificate string `json:"tls_certificate" structs:"tls_certificate" mapstructure:"tls_certificate"`
+	TLSPrivateKey  string `json:"tls_private_key" structs:"tls_private_key" mapstructure:"tls_private_key"`
+	InsecureTLS    bool   `json:"insecure_tls" structs:"insecure_tls" mapstructure:"insecure_tls"`
+	TLSSkipVerify  bool   `json:"tls_skip_verify" structs:"tls_skip_verify" mapstructure:"tls_skip_verify"`
+	HostsAltName   string `json:"hosts_alt_name" structs:"hosts_alt_name" mapstructure:"hosts_alt_name"`
+
 	Type        string
 	Initialized bool
 	RawConfig   map[string]interface{}
 
-	cluster        *gocb.Cluster
-	clusterManager *gocb.ClusterManager
+	cluster *gocb.Cluster
 	sync.Mutex
 }
 
@@ -57,50 +66,112 @@ func (c *couchbaseConnectionProducer) Init(ctx context.Context, conf map[string]
 	c.Initialized = true
 
 	if verifyConnection {
-		if _, err := c.Connection(ctx); err != nil {
+		cluster, err := c.connection(ctx)
+		if err != nil {
 			return nil, errwrap.Wrapf("error verifying connection: {{err}}", err)
 		}
+
+		if err := cluster.WaitUntilReady(30*time.Second, nil); err != nil {
+			return nil, errwrap.Wrapf("error waiting for cluster to become ready: {{err}}", err)
+		}
 	}
 
 	return conf, nil
 }
 
-func (c *couchbaseConnectionProducer) Connection(context.Context) (interface{}, error) {
+// Connection returns the shared cluster handle, lazily creating and
+// authenticating it on first use. Unlike the v1 client, gocb v2 exposes
+// Cluster.Users() directly, so no bucket needs to be opened just to
+// perform cluster-level RBAC operations.
+func (c *couchbaseConnectionProducer) Connection(ctx context.Context) (interface{}, error) {
+	return c.connection(ctx)
+}
+
+// connection is the typed counterpart of Connection. Callers that need a
+// *gocb.Cluster instead of an interface{} can call this directly.
+func (c *couchbaseConnectionProducer) connection(ctx context.Context) (*gocb.Cluster, error) {
 	if !c.Initialized {
 		return nil, connutil.ErrNotInitialized
 	}
 
-	cluster, err := gocb.Connect(c.ConnectionString)
-	if err != nil {
-		return nil, err
+	if c.cluster != nil {
+		return c.cluster, nil
 	}
 
-	cluster.SetConnectTimeout(time.Second * 30)
-	cluster.SetServerConnectTimeout(time.Second * 30)
-
-	if err = cluster.Authenticate(gocb.PasswordAuthenticator{Username: c.Username, Password: c.Password}); err != nil {
-		return nil, err
+	clusterOpts := gocb.ClusterOptions{
+		Authenticator: gocb.PasswordAuthenticator{
+			Username: c.Username,
+			Password: c.Password,
+		},
 	}
 
-	// must open a bucket in order to perform cluster level operations
-	if _, err = cluster.OpenBucket(c.Bucket, ""); err != nil {
-		return nil, errors.Wrapf(err, "could not open bucket %s", c.Bucket)
+	if strings.HasPrefix(strings.ToLower(c.ConnectionString), "couchbases://") {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, errwrap.Wrapf("error building TLS config: {{err}}", err)
+		}
+
+		clusterOpts.SecurityConfig = gocb.SecurityConfig{
+			TLSSkipVerify: c.InsecureTLS || c.TLSSkipVerify,
+			TLSRootCAs:    tlsConfig.RootCAs,
+		}
+
+		// a client keypair was supplied, so authenticate with the
+		// certificate instead of the configured username/password
+		if len(tlsConfig.Certificates) > 0 {
+			clusterOpts.Authenticator = gocb.CertificateAuthenticator{
+				ClientCertificate: &tlsConfig.Certificates[0],
+			}
+		}
+	} else if len(c.TLSCA) > 0 || len(c.TLSCertificate) > 0 {
+		// TLS material was configured but connection_string won't use it;
+		// fail loudly instead of silently falling back to a plaintext
+		// connection authenticated with the plugin's username/password.
+		return nil, fmt.Errorf("tls_ca/tls_certificate were provided but connection_string does not use the couchbases:// scheme")
 	}
 
-	clusterManager := cluster.Manager(c.Username, c.Password)
+	cluster, err := gocb.Connect(c.ConnectionString, clusterOpts)
+	if err != nil {
+		return nil, err
+	}
 
 	c.cluster = cluster
-	c.clusterManager = clusterManager
 
 	return c.cluster, nil
 }
 
+// tlsConfig builds a *tls.Config from the configured CA bundle and optional
+// client keypair, for use against couchbases:// endpoints.
+func (c *couchbaseConnectionProducer) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: c.HostsAltName,
+	}
+
+	if len(c.TLSCA) > 0 {
+		certPool := x509.NewCertPool()
+		if ok := certPool.AppendCertsFromPEM([]byte(c.TLSCA)); !ok {
+			return nil, fmt.Errorf("failed to parse tls_ca")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if len(c.TLSCertificate) > 0 && len(c.TLSPrivateKey) > 0 {
+		clientCert, err := tls.X509KeyPair([]byte(c.TLSCertificate), []byte(c.TLSPrivateKey))
+		if err != nil {
+			return nil, errwrap.Wrapf("error parsing tls_certificate/tls_private_key: {{err}}", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
 func (c *couchbaseConnectionProducer) Close() error {
 	c.Lock()
 	defer c.Unlock()
 
 	if c.cluster != nil {
-		if err := c.cluster.Close(); err != nil {
+		if err := c.cluster.Close(nil); err != nil {
 			return err
 		}
 	}
@@ -109,8 +180,9 @@ func (c *couchbaseConnectionProducer) Close() error {
 	return nil
 }
 
-func (c *couchbaseConnectionProducer) secretValues() map[string]interface{} {
-	return map[string]interface{}{
-		c.Password: "[password]",
+func (c *couchbaseConnectionProducer) secretValues() map[string]string {
+	return map[string]string{
+		c.Password:      "[password]",
+		c.TLSPrivateKey: "[tls_private_key]",
 	}
 }
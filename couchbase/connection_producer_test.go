@@ -0,0 +1,115 @@
+package couchbase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func generateTestCert(t *testing.T) (certPEM string, keyPEM string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NilError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "couchbase-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NilError(t, err)
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	priv := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return string(cert), string(priv)
+}
+
+func TestTlsConfig(t *testing.T) {
+	caCert, _ := generateTestCert(t)
+	clientCert, clientKey := generateTestCert(t)
+	_, otherKey := generateTestCert(t)
+
+	t.Run("no tls fields set", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{HostsAltName: "couchbase.example.com"}
+
+		tlsConfig, err := c.tlsConfig()
+		assert.NilError(t, err)
+		assert.Equal(t, tlsConfig.ServerName, "couchbase.example.com")
+		assert.Assert(t, tlsConfig.RootCAs == nil)
+		assert.Equal(t, len(tlsConfig.Certificates), 0)
+	})
+
+	t.Run("valid ca", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{TLSCA: caCert}
+
+		tlsConfig, err := c.tlsConfig()
+		assert.NilError(t, err)
+		assert.Assert(t, tlsConfig.RootCAs != nil)
+	})
+
+	t.Run("invalid ca pem", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{TLSCA: "not a valid pem"}
+
+		_, err := c.tlsConfig()
+		assert.ErrorContains(t, err, "failed to parse tls_ca")
+	})
+
+	t.Run("valid client cert and key", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{TLSCertificate: clientCert, TLSPrivateKey: clientKey}
+
+		tlsConfig, err := c.tlsConfig()
+		assert.NilError(t, err)
+		assert.Equal(t, len(tlsConfig.Certificates), 1)
+	})
+
+	t.Run("mismatched client cert and key", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{TLSCertificate: clientCert, TLSPrivateKey: otherKey}
+
+		_, err := c.tlsConfig()
+		assert.ErrorContains(t, err, "error parsing tls_certificate/tls_private_key")
+	})
+}
+
+func TestConnection_TLSConfiguredWithoutSecureScheme(t *testing.T) {
+	caCert, _ := generateTestCert(t)
+
+	t.Run("tls_ca set but scheme is couchbase://", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{
+			ConnectionString: "couchbase://localhost",
+			Username:         "admin",
+			Password:         "password",
+			Initialized:      true,
+			TLSCA:            caCert,
+		}
+
+		_, err := c.connection(context.Background())
+		assert.ErrorContains(t, err, "couchbases://")
+	})
+
+	t.Run("scheme check is case-insensitive", func(t *testing.T) {
+		c := &couchbaseConnectionProducer{
+			ConnectionString: "COUCHBASE://localhost",
+			Username:         "admin",
+			Password:         "password",
+			Initialized:      true,
+			TLSCA:            caCert,
+		}
+
+		_, err := c.connection(context.Background())
+		assert.ErrorContains(t, err, "couchbases://")
+	})
+}
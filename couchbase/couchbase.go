@@ -4,13 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/hashicorp/vault/api"
-	"github.com/hashicorp/vault/sdk/database/dbplugin"
+	"log"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/hashicorp/errwrap"
+	legacydbplugin "github.com/hashicorp/vault/sdk/database/dbplugin"
+	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
 	"github.com/hashicorp/vault/sdk/database/helper/credsutil"
-	"github.com/hashicorp/vault/sdk/database/helper/dbutil"
 	"github.com/pkg/errors"
-	"gopkg.in/couchbase/gocb.v1"
-	"time"
 )
 
 const (
@@ -26,13 +27,13 @@ type Couchbase struct {
 
 var _ dbplugin.Database = &Couchbase{}
 
-func Run(apiTLSConfig *api.TLSConfig) error {
+func Run() error {
 	dbType, err := New()
 	if err != nil {
 		return err
 	}
 
-	dbplugin.Serve(dbType.(dbplugin.Database), api.VaultPluginTLSProvider(apiTLSConfig))
+	dbplugin.Serve(dbType.(dbplugin.Database))
 
 	return nil
 }
@@ -66,95 +67,213 @@ func (c *Couchbase) Type() (string, error) {
 	return couchbaseTypeName, nil
 }
 
-// Generates username and password, creates a user in the database with those credentials
-func (c *Couchbase) CreateUser(ctx context.Context, statements dbplugin.Statements, usernameConfig dbplugin.UsernameConfig, expiration time.Time) (username string, password string, err error) {
+// Initialize configures the connection producer and optionally verifies
+// connectivity to the cluster.
+func (c *Couchbase) Initialize(ctx context.Context, req dbplugin.InitializeRequest) (dbplugin.InitializeResponse, error) {
+	newConf, err := c.Init(ctx, req.Config, req.VerifyConnection)
+	if err != nil {
+		return dbplugin.InitializeResponse{}, err
+	}
+
+	return dbplugin.InitializeResponse{Config: newConf}, nil
+}
+
+// NewUser generates a username and creates a user in the database with the
+// requested roles and/or groups.
+func (c *Couchbase) NewUser(ctx context.Context, req dbplugin.NewUserRequest) (dbplugin.NewUserResponse, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	statements = dbutil.StatementCompatibilityHelper(statements)
-
-	if len(statements.Creation) == 0 {
-		return "", "", dbutil.ErrEmptyCreationStatement
+	if len(req.Statements.Commands) == 0 {
+		return dbplugin.NewUserResponse{}, fmt.Errorf("creation statement is required")
 	}
 
-	_, err = c.Connection(ctx)
+	cluster, err := c.connection(ctx)
 	if err != nil {
-		return "", "", err
+		return dbplugin.NewUserResponse{}, err
 	}
 
-	username, err = c.GenerateUsername(usernameConfig)
+	username, err := c.GenerateUsername(legacydbplugin.UsernameConfig{
+		DisplayName: req.UsernameConfig.DisplayName,
+		RoleName:    req.UsernameConfig.RoleName,
+	})
 	if err != nil {
-		return "", "", err
+		return dbplugin.NewUserResponse{}, err
 	}
 
-	password, err = c.GeneratePassword()
-	if err != nil {
-		return "", "", err
+	if err := upsertUser(cluster, req.Statements.Commands[0], username, req.Password); err != nil {
+		return dbplugin.NewUserResponse{}, err
 	}
 
-	return upsertUser(c.clusterManager, statements.Creation[0], username, password)
+	return dbplugin.NewUserResponse{Username: username}, nil
 }
 
-// Sets or creates a user with the given username and password
-func (c *Couchbase) SetCredentials(ctx context.Context, statements dbplugin.Statements, staticConfig dbplugin.StaticUserConfig) (username string, password string, err error) {
+// UpdateUser changes a user's password. When the target is the plugin's own
+// configured admin user, this is how Vault performs root credential
+// rotation; expiration-only updates are a no-op, since couchbase users
+// don't expire.
+func (c *Couchbase) UpdateUser(ctx context.Context, req dbplugin.UpdateUserRequest) (dbplugin.UpdateUserResponse, error) {
+	if req.Password == nil {
+		return dbplugin.UpdateUserResponse{}, nil
+	}
+
 	c.Lock()
 	defer c.Unlock()
 
-	statements = dbutil.StatementCompatibilityHelper(statements)
+	if req.Username == c.Username {
+		_, err := c.rotateRootCredentials(ctx, req.Password.NewPassword)
+		return dbplugin.UpdateUserResponse{}, err
+	}
 
-	if len(statements.Creation) == 0 {
-		return "", "", dbutil.ErrEmptyCreationStatement
+	cluster, err := c.connection(ctx)
+	if err != nil {
+		return dbplugin.UpdateUserResponse{}, err
 	}
 
-	_, err = c.Connection(ctx)
+	user, err := cluster.Users().GetUser(req.Username, &gocb.GetUserOptions{DomainName: authDomain})
 	if err != nil {
-		return "", "", err
+		return dbplugin.UpdateUserResponse{}, errors.Wrap(err, "error looking up user to update")
 	}
 
-	return upsertUser(c.clusterManager, statements.Creation[0], staticConfig.Username, staticConfig.Password)
-}
+	user.Password = req.Password.NewPassword
 
-// not supported in couchbase
-func (c *Couchbase) RenewUser(ctx context.Context, statements dbplugin.Statements, username string, expiration time.Time) error {
-	return nil
+	if err := cluster.Users().UpsertUser(user.User, &gocb.UpsertUserOptions{DomainName: authDomain}); err != nil {
+		return dbplugin.UpdateUserResponse{}, errors.Wrap(err, "error updating user password")
+	}
+
+	return dbplugin.UpdateUserResponse{}, nil
 }
 
-// deletes user with the given username
-func (c *Couchbase) RevokeUser(ctx context.Context, statements dbplugin.Statements, username string) error {
+// DeleteUser deletes the user with the given username.
+func (c *Couchbase) DeleteUser(ctx context.Context, req dbplugin.DeleteUserRequest) (dbplugin.DeleteUserResponse, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	_, err := c.Connection(ctx)
+	cluster, err := c.connection(ctx)
 	if err != nil {
-		return err
+		return dbplugin.DeleteUserResponse{}, err
+	}
+
+	if err := cluster.Users().DropUser(req.Username, &gocb.DropUserOptions{DomainName: authDomain}); err != nil {
+		return dbplugin.DeleteUserResponse{}, err
 	}
 
-	return c.clusterManager.RemoveUser(authDomain, username)
+	return dbplugin.DeleteUserResponse{}, nil
 }
 
-// not supported in couchbase
-func (c *Couchbase) RotateRootCredentials(ctx context.Context, statements []string) (config map[string]interface{}, err error) {
-	return nil, errors.New("root credential rotation is not currently implemented in couchbase")
+// rotateRootCredentials performs the actual rotation; callers must hold c.Lock().
+func (c *Couchbase) rotateRootCredentials(ctx context.Context, newPassword string) (map[string]interface{}, error) {
+	cluster, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rootUser, err := cluster.Users().GetUser(c.Username, &gocb.GetUserOptions{DomainName: authDomain})
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking up root user")
+	}
+
+	err = cluster.Users().UpsertUser(gocb.User{
+		Username: c.Username,
+		Password: newPassword,
+		Roles:    rootUser.Roles,
+		Groups:   rootUser.Groups,
+	}, &gocb.UpsertUserOptions{DomainName: authDomain})
+	if err != nil {
+		return nil, errors.Wrap(err, "error rotating root credentials")
+	}
+
+	c.Password = newPassword
+	c.RawConfig["password"] = newPassword
+
+	// The password has already been changed in Couchbase and Vault has
+	// already recorded it above, so nothing past this point may fail the
+	// rotation: doing so would leave Vault's stored root credential out of
+	// sync with Couchbase with no recovery short of a manual fix. Reconnecting
+	// is only a best-effort confirmation that the new password works.
+	if err := c.cluster.Close(nil); err != nil {
+		log.Printf("[WARN] error closing couchbase connection after rotating root credentials: %s", err)
+		c.cluster = nil
+		return c.RawConfig, nil
+	}
+	c.cluster = nil
+
+	if _, err := c.connection(ctx); err != nil {
+		log.Printf("[WARN] error verifying rotated root credentials: %s", err)
+	}
+
+	return c.RawConfig, nil
 }
 
-func upsertUser(clusterManager *gocb.ClusterManager, creationStatement string, username string, password string) (string, string, error) {
+// upsertUser creates username with the roles from creationStatement, then
+// assigns any requested groups as a follow-up step. If that follow-up step
+// fails, the statement's rollback instructions (if any) are executed to
+// avoid leaving behind a partially-provisioned user.
+func upsertUser(cluster *gocb.Cluster, creationStatement string, username string, password string) error {
 	var cbStatement CbStatement
 	err := json.Unmarshal([]byte(creationStatement), &cbStatement)
 	if err != nil {
-		return "", "", errors.Wrap(err, "invalid creation statement")
+		return errors.Wrap(err, "invalid creation statement")
 	}
 
-	if len(cbStatement.Roles) == 0 {
-		return "", "", fmt.Errorf("at least one role should be given in creation statement")
+	if len(cbStatement.Roles) == 0 && len(cbStatement.Groups) == 0 {
+		return fmt.Errorf("at least one role or group should be given in creation statement")
 	}
 
-	if err = clusterManager.UpsertUser(authDomain, username, &gocb.UserSettings{
-		Name:     username,
+	if err := cluster.Users().UpsertUser(gocb.User{
+		Username: username,
 		Password: password,
 		Roles:    cbStatement.Roles.ToGocbUserRoles(),
-	}); err != nil {
-		return "", "", errors.Wrap(err, "error when upserting user")
+	}, &gocb.UpsertUserOptions{DomainName: authDomain}); err != nil {
+		return errors.Wrap(err, "error when upserting user")
+	}
+
+	if err := assignGroups(cluster, username, cbStatement.Groups); err != nil {
+		if rollbackErr := runRollback(cluster, username, cbStatement.Rollback); rollbackErr != nil {
+			return errwrap.Wrapf(fmt.Sprintf("error assigning groups, and rollback failed: {{err}} (original error: %s)", err), rollbackErr)
+		}
+		return errors.Wrap(err, "error assigning groups to user")
+	}
+
+	return nil
+}
+
+// assignGroups re-upserts the user with its group membership once the base
+// user and its roles have already been created successfully.
+func assignGroups(cluster *gocb.Cluster, username string, groups []string) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	user, err := cluster.Users().GetUser(username, &gocb.GetUserOptions{DomainName: authDomain})
+	if err != nil {
+		return errors.Wrap(err, "error looking up newly created user")
 	}
 
-	return username, password, nil
+	user.Groups = groups
+
+	return cluster.Users().UpsertUser(user.User, &gocb.UpsertUserOptions{DomainName: authDomain})
+}
+
+// rollbackDropUser is the only rollback statement currently recognized; it
+// undoes a partially created user by dropping it outright.
+const rollbackDropUser = "drop_user"
+
+// runRollback undoes a partially created user when a follow-up step, such
+// as group assignment, fails after the user itself was created. Each entry
+// in rollback is dispatched by name; an unrecognized statement is an error
+// rather than being silently ignored.
+func runRollback(cluster *gocb.Cluster, username string, rollback []string) error {
+	for _, statement := range rollback {
+		switch statement {
+		case rollbackDropUser:
+			if err := cluster.Users().DropUser(username, &gocb.DropUserOptions{DomainName: authDomain}); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unrecognized rollback statement: %q", statement)
+		}
+	}
+
+	return nil
 }
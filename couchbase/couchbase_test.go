@@ -4,12 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/hashicorp/go-retryablehttp"
-	"github.com/hashicorp/vault/sdk/database/dbplugin"
-	"github.com/ory/dockertest"
-	"github.com/ory/dockertest/docker"
-	"gopkg.in/couchbase/gocb.v1"
-	"gotest.tools/assert"
 	"log"
 	"net/http"
 	"net/url"
@@ -17,6 +11,13 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/hashicorp/vault/sdk/database/dbplugin/v5"
+	"github.com/ory/dockertest"
+	"github.com/ory/dockertest/docker"
+	"gotest.tools/assert"
 )
 
 const (
@@ -68,9 +69,11 @@ func TestMain(m *testing.M) {
 
 	// exponential backoff-retry, because container might not be ready to accept connections yet
 	if err := pool.Retry(func() error {
-		var err error
-		cluster, err = gocb.Connect("couchbase://localhost")
-		return err
+		probe, err := gocb.Connect("couchbase://localhost", gocb.ClusterOptions{})
+		if err != nil {
+			return err
+		}
+		return probe.Close(nil)
 	}); err != nil {
 		log.Fatalf("could not connect to couchbase container: %s", err)
 	}
@@ -79,7 +82,14 @@ func TestMain(m *testing.M) {
 		log.Fatalf("could not configure couchbase cluster: %s", err)
 	}
 
-	if err := cluster.Authenticate(gocb.PasswordAuthenticator{Username: cbUsername, Password: cbPassword,}); err != nil {
+	// the admin user was just created above, so reconnect now that it can authenticate
+	if err := pool.Retry(func() error {
+		var err error
+		cluster, err = gocb.Connect("couchbase://localhost", gocb.ClusterOptions{
+			Authenticator: gocb.PasswordAuthenticator{Username: cbUsername, Password: cbPassword},
+		})
+		return err
+	}); err != nil {
 		log.Fatalf("could not authenticate to couchbase: %s", err)
 	}
 
@@ -90,20 +100,12 @@ func TestMain(m *testing.M) {
 	}
 
 	// to make sure bucket is created and ready, trying to open it with retry
-	var bucket *gocb.Bucket
 	if err := pool.Retry(func() error {
-		var err error
-		bucket, err = cluster.OpenBucket(cbBucketName, "")
-		return err
+		return cluster.Bucket(cbBucketName).WaitUntilReady(10*time.Second, nil)
 	}); err != nil {
 		log.Fatalf("could not open bucket: %s", err)
 	}
 
-	// opened the bucket just to be sure that it's created successfully, now closing it
-	if err = bucket.Close(); err != nil {
-		log.Fatalf("could not close the bucket: %s", err)
-	}
-
 	// cluster and bucket is ready, run the tests
 	code := m.Run()
 
@@ -115,9 +117,9 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func TestCouchbase_Init(t *testing.T) {
+func TestCouchbase_Initialize(t *testing.T) {
 	cb := new()
-	_, err := cb.Init(context.Background(), conf, true)
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
 	assert.NilError(t, err)
 
 	assert.Equal(t, cb.Initialized, true)
@@ -127,72 +129,233 @@ func TestCouchbase_Init(t *testing.T) {
 	assert.Equal(t, cb.ConnectionString, "couchbase://localhost")
 }
 
-func TestCouchbase_CreateUser(t *testing.T) {
+func TestCouchbase_NewUser(t *testing.T) {
 	cb := new()
-	_, err := cb.Init(context.Background(), conf, true)
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	password, err := cb.GeneratePassword()
 	assert.NilError(t, err)
 
 	// create a user with role bucket_full_access on bucket Test
-	username, password, err := cb.CreateUser(context.Background(), dbplugin.Statements{
-		Creation: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
-	}, dbplugin.UsernameConfig{DisplayName: "test-user", RoleName: "test-role"}, time.Now().Add(time.Hour))
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       password,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
+	})
+	assert.NilError(t, err)
+	username := resp.Username
+
+	user, err := cb.cluster.Users().GetUser(username, &gocb.GetUserOptions{DomainName: authDomain})
+	assert.NilError(t, err)
+
+	authCluster, err := gocb.Connect("couchbase://localhost", gocb.ClusterOptions{
+		Authenticator: gocb.PasswordAuthenticator{Username: username, Password: password},
+	})
+	assert.NilError(t, err)
+	defer authCluster.Close(nil)
+
+	assert.Equal(t, user.Username, username)
+	assert.Equal(t, user.Roles[0].Bucket, cbBucketName)
+	assert.Equal(t, user.Roles[0].Name, "bucket_full_access")
+}
+
+func TestCouchbase_NewUser_ScopedRole(t *testing.T) {
+	cb := new()
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	password, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       password,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf(`{"roles": [{"role": "data_reader", "bucket_name": "%s", "scope_name": "_default", "collection_name": "_default"}]}`, cbBucketName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
+	})
 	assert.NilError(t, err)
 
-	user, err := cb.clusterManager.GetUser("local", username)
+	user, err := cb.cluster.Users().GetUser(resp.Username, &gocb.GetUserOptions{DomainName: authDomain})
 	assert.NilError(t, err)
 
-	err = cb.cluster.Authenticate(gocb.PasswordAuthenticator{
-		Username: username,
-		Password: password,
+	assert.Equal(t, user.Roles[0].Bucket, cbBucketName)
+	assert.Equal(t, user.Roles[0].Scope, "_default")
+	assert.Equal(t, user.Roles[0].Collection, "_default")
+}
+
+func TestCouchbase_NewUser_GroupOnly(t *testing.T) {
+	cb := new()
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	groupName := "test-group"
+	err = createGroup(groupName)
+	assert.NilError(t, err)
+
+	password, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       password,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf(`{"groups": ["%s"]}`, groupName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
 	})
 	assert.NilError(t, err)
 
-	assert.Equal(t, user.Name, username)
-	assert.Equal(t, user.Roles[0].BucketName, cbBucketName)
-	assert.Equal(t, user.Roles[0].Role, "bucket_full_access")
+	user, err := cb.cluster.Users().GetUser(resp.Username, &gocb.GetUserOptions{DomainName: authDomain})
+	assert.NilError(t, err)
+
+	assert.Equal(t, len(user.Groups), 1)
+	assert.Equal(t, user.Groups[0], groupName)
+}
+
+func TestCouchbase_NewUser_RollbackOnGroupFailure(t *testing.T) {
+	cb := new()
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	password, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	username := "test-user-rollback"
+
+	// the group does not exist, so assignGroups fails after the user has
+	// already been created with its roles; the rollback statement should
+	// then drop the partially-provisioned user
+	creationStatement := fmt.Sprintf(
+		`{"roles": [{"role": "bucket_full_access", "bucket_name": "%s"}], "groups": ["does-not-exist"], "rollback": ["drop_user"]}`,
+		cbBucketName)
+	err = upsertUser(cb.cluster, creationStatement, username, password)
+	assert.ErrorContains(t, err, "error assigning groups to user")
+
+	_, err = cb.cluster.Users().GetUser(username, &gocb.GetUserOptions{DomainName: authDomain})
+	assert.ErrorContains(t, err, "Unknown user")
+}
+
+func TestRunRollback_UnrecognizedStatement(t *testing.T) {
+	cb := new()
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	err = runRollback(cb.cluster, "irrelevant-user", []string{"truncate_everything"})
+	assert.ErrorContains(t, err, "unrecognized rollback statement")
 }
 
-func TestCouchbase_RevokeUser(t *testing.T) {
+func TestCouchbase_DeleteUser(t *testing.T) {
 	cb := new()
-	_, err := cb.Init(context.Background(), conf, true)
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
 	assert.NilError(t, err)
 
-	username, _, err := cb.CreateUser(context.Background(), dbplugin.Statements{
-		Creation: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
-	}, dbplugin.UsernameConfig{DisplayName: "test-user", RoleName: "test-role"}, time.Now().Add(time.Hour))
+	password, err := cb.GeneratePassword()
 	assert.NilError(t, err)
 
-	err = cb.RevokeUser(context.Background(), dbplugin.Statements{}, username)
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       password,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
+	})
+	assert.NilError(t, err)
+
+	_, err = cb.DeleteUser(context.Background(), dbplugin.DeleteUserRequest{Username: resp.Username})
 	assert.NilError(t, err)
 
-	_, err = cb.clusterManager.GetUser("local", username)
+	_, err = cb.cluster.Users().GetUser(resp.Username, &gocb.GetUserOptions{DomainName: authDomain})
 	assert.Error(t, err, "\"Unknown user.\"")
 }
 
-func TestCouchbase_SetCredentials(t *testing.T) {
+func TestCouchbase_UpdateUser(t *testing.T) {
 	cb := new()
-	_, err := cb.Init(context.Background(), conf, true)
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: conf, VerifyConnection: true})
+	assert.NilError(t, err)
+
+	oldPassword, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       oldPassword,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
+	})
+	assert.NilError(t, err)
+
+	newPassword, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	_, err = cb.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: resp.Username,
+		Password: &dbplugin.ChangePassword{NewPassword: newPassword},
+	})
 	assert.NilError(t, err)
 
-	username, password, err := cb.SetCredentials(context.Background(), dbplugin.Statements{
-		Creation: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
-	}, dbplugin.StaticUserConfig{
-		Username: "test-user",
-		Password: "test-password",
+	authCluster, err := gocb.Connect("couchbase://localhost", gocb.ClusterOptions{
+		Authenticator: gocb.PasswordAuthenticator{Username: resp.Username, Password: newPassword},
 	})
+	assert.NilError(t, err)
+	defer authCluster.Close(nil)
+}
 
-	user, err := cb.clusterManager.GetUser("local", username)
+// TestCouchbase_UpdateUser_RootRotation exercises root credential rotation
+// the way Vault actually triggers it: an UpdateUser call whose Username
+// matches the plugin's own configured admin user.
+func TestCouchbase_UpdateUser_RootRotation(t *testing.T) {
+	cb := new()
+	rotateConf := map[string]interface{}{
+		"connection_string": "couchbase://localhost",
+		"username":          cbUsername,
+		"password":          cbPassword,
+		"bucket":            cbBucketName,
+	}
+	_, err := cb.Initialize(context.Background(), dbplugin.InitializeRequest{Config: rotateConf, VerifyConnection: true})
 	assert.NilError(t, err)
 
-	err = cb.cluster.Authenticate(gocb.PasswordAuthenticator{
-		Username: username,
-		Password: password,
+	newPassword, err := cb.GeneratePassword()
+	assert.NilError(t, err)
+
+	_, err = cb.UpdateUser(context.Background(), dbplugin.UpdateUserRequest{
+		Username: cbUsername,
+		Password: &dbplugin.ChangePassword{NewPassword: newPassword},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, cb.Password, newPassword)
+
+	// the cluster handle held by cb was reconnected with the rotated
+	// credentials, so NewUser should keep working against it
+	resp, err := cb.NewUser(context.Background(), dbplugin.NewUserRequest{
+		UsernameConfig: dbplugin.UsernameMetadata{DisplayName: "test-user", RoleName: "test-role"},
+		Password:       cbPassword,
+		Statements: dbplugin.Statements{
+			Commands: []string{fmt.Sprintf("{\"roles\": [{\"role\": \"bucket_full_access\",\"bucket_name\": \"%s\"}]}", cbBucketName)},
+		},
+		Expiration: time.Now().Add(time.Hour),
 	})
 	assert.NilError(t, err)
 
-	assert.Equal(t, user.Name, username)
-	assert.Equal(t, user.Roles[0].BucketName, cbBucketName)
-	assert.Equal(t, user.Roles[0].Role, "bucket_full_access")
+	_, err = cb.cluster.Users().GetUser(resp.Username, &gocb.GetUserOptions{DomainName: authDomain})
+	assert.NilError(t, err)
+
+	// restore the admin password so later tests in the suite can still
+	// authenticate against the shared container
+	err = cluster.Users().UpsertUser(gocb.User{
+		Username: cbUsername,
+		Password: cbPassword,
+		Roles:    []gocb.Role{{Name: "admin"}},
+	}, &gocb.UpsertUserOptions{DomainName: authDomain})
+	assert.NilError(t, err)
 }
 
 func configureCouchbaseCluster() error {
@@ -253,8 +416,28 @@ func createBucket() error {
 	return nil
 }
 
+func createGroup(name string) error {
+	if resp, err := putFormWithRetry(fmt.Sprintf("http://localhost:8091/settings/rbac/groups/%s", name), url.Values{
+		"roles": {fmt.Sprintf("bucket_full_access[%s]", cbBucketName)},
+	}); err != nil {
+		return err
+	} else if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("could not create test group. response status: %d", resp.StatusCode))
+	}
+
+	return nil
+}
+
 func postFormWithRetry(url string, form url.Values) (*http.Response, error) {
-	req, err := retryablehttp.NewRequest(http.MethodPost, url, strings.NewReader(form.Encode()))
+	return doFormWithRetry(http.MethodPost, url, form)
+}
+
+func putFormWithRetry(url string, form url.Values) (*http.Response, error) {
+	return doFormWithRetry(http.MethodPut, url, form)
+}
+
+func doFormWithRetry(method string, url string, form url.Values) (*http.Response, error) {
+	req, err := retryablehttp.NewRequest(method, url, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
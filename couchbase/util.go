@@ -1,10 +1,12 @@
 package couchbase
 
-import "gopkg.in/couchbase/gocb.v1"
+import "github.com/couchbase/gocb/v2"
 
 type CbRole struct {
-	Role       string `json:"role"`
-	BucketName string `json:"bucket_name"`
+	Role           string `json:"role"`
+	BucketName     string `json:"bucket_name"`
+	ScopeName      string `json:"scope_name,omitempty"`
+	CollectionName string `json:"collection_name,omitempty"`
 }
 
 type CbRoles []CbRole
@@ -15,20 +17,33 @@ type CbRoles []CbRole
 //	   "roles": [
 //	      {
 //		     "role": "bucket_admin",
-//			 "bucket_name": "Products"
+//			 "bucket_name": "Products",
+//			 "scope_name": "tenant_a",
+//			 "collection_name": "orders"
 //	      }
-//	   ]
+//	   ],
+//	   "groups": ["readonly_group"],
+//	   "rollback": ["drop_user"]
 //  }
 type CbStatement struct {
-	Roles CbRoles `json:"roles"`
+	Roles  CbRoles  `json:"roles"`
+	Groups []string `json:"groups"`
+
+	// Rollback lists statements to run if the user is created successfully
+	// but a follow-up step, such as group assignment, subsequently fails.
+	// The only statement currently recognized is "drop_user", which drops
+	// the partially-provisioned user; any other value is an error.
+	Rollback []string `json:"rollback"`
 }
 
-func (roles CbRoles) ToGocbUserRoles() []gocb.UserRole {
-	var userRoles []gocb.UserRole
+func (roles CbRoles) ToGocbUserRoles() []gocb.Role {
+	var userRoles []gocb.Role
 	for _, r := range []CbRole(roles) {
-		userRoles = append(userRoles, gocb.UserRole{
-			Role:       r.Role,
-			BucketName: r.BucketName,
+		userRoles = append(userRoles, gocb.Role{
+			Name:       r.Role,
+			Bucket:     r.BucketName,
+			Scope:      r.ScopeName,
+			Collection: r.CollectionName,
 		})
 	}
 
@@ -2,18 +2,12 @@ package main
 
 import (
 	"couchbase-database-plugin/couchbase"
-	"github.com/hashicorp/vault/api"
 	"log"
 	"os"
 )
 
 func main() {
-	apiClientMeta := &api.PluginAPIClientMeta{}
-	flags := apiClientMeta.FlagSet()
-	flags.Parse(os.Args[1:])
-
-	err := couchbase.Run(apiClientMeta.GetTLSConfig())
-	if err != nil {
+	if err := couchbase.Run(); err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}